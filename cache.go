@@ -0,0 +1,97 @@
+package singlefleet
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// cacheEntry is a single cached Fetch outcome: a value that was found (ok),
+// or a recorded "not found" (negative cache entry), valid until expires.
+type cacheEntry struct {
+	val     interface{}
+	ok      bool
+	expires time.Time
+}
+
+// cacheElem is the payload stored in each cache LRU list element.
+type cacheElem struct {
+	id    string
+	entry cacheEntry
+}
+
+// cache is a small LRU cache of Fetch outcomes keyed by ID, bounded to size
+// entries (unbounded if size <= 0). It is safe for concurrent use.
+type cache struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+func newCache(size int) *cache {
+	return &cache{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// get looks up id, reporting the cached val/ok and whether a live (non-
+// expired) entry was found at all.
+func (c *cache) get(id string) (val interface{}, ok bool, found bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, exists := c.items[id]
+	if !exists {
+		return nil, false, false
+	}
+	ce := el.Value.(*cacheElem)
+	if time.Now().After(ce.entry.expires) {
+		c.ll.Remove(el)
+		delete(c.items, id)
+		return nil, false, false
+	}
+	c.ll.MoveToFront(el)
+	return ce.entry.val, ce.entry.ok, true
+}
+
+// set stores val/ok for id, valid for ttl, evicting the least recently used
+// entry if the cache is over capacity.
+func (c *cache) set(id string, val interface{}, ok bool, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := cacheEntry{val: val, ok: ok, expires: time.Now().Add(ttl)}
+	if el, exists := c.items[id]; exists {
+		el.Value.(*cacheElem).entry = entry
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	el := c.ll.PushFront(&cacheElem{id: id, entry: entry})
+	c.items[id] = el
+
+	for c.size > 0 && c.ll.Len() > c.size {
+		back := c.ll.Back()
+		if back == nil {
+			break
+		}
+		c.ll.Remove(back)
+		delete(c.items, back.Value.(*cacheElem).id)
+	}
+}
+
+// invalidate evicts ids from the cache, if present.
+func (c *cache) invalidate(ids ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, id := range ids {
+		if el, exists := c.items[id]; exists {
+			c.ll.Remove(el)
+			delete(c.items, id)
+		}
+	}
+}
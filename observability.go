@@ -0,0 +1,97 @@
+package singlefleet
+
+import (
+	"context"
+	"time"
+)
+
+// An Observer receives callbacks about a Fetcher's batching behavior, for
+// wiring up metrics such as batch size distributions and wait-time-vs-
+// max-batch-fill, to help tune maxWait/maxBatch. Implementations must be
+// safe for concurrent use; methods may be called from multiple goroutines
+// and must not block.
+type Observer interface {
+	// OnBatchStart is called just before a batch's Job or JobContext runs,
+	// with the number of IDs it covers.
+	OnBatchStart(size int)
+	// OnBatchEnd is called once a batch's Job or JobContext has returned (or
+	// timed out, per MaxJobDuration), with its size, how long it ran, and
+	// the error it produced, if any.
+	OnBatchEnd(size int, dur time.Duration, err error)
+	// OnFetchEnqueued is called when an ID is newly queued into a batch,
+	// i.e. it is not a dedup of an already-queued caller for that ID.
+	OnFetchEnqueued(id string)
+	// OnFetchWait is called once a Fetch/FetchContext/FetchWithPriority call
+	// for id returns from waiting on a batch, with how long that caller
+	// waited. Calls served from the result cache (see WithCache) are not
+	// reported.
+	OnFetchWait(id string, dur time.Duration)
+}
+
+// Span is the minimal span interface singlefleet needs from a tracing
+// library. To integrate a real tracer (e.g. OpenTelemetry), wrap its span
+// type in a small adapter implementing Span.
+type Span interface {
+	End()
+}
+
+// Tracer is the minimal tracer interface singlefleet needs to open a span
+// around each batch's Job/JobContext call, linking it to the context of the
+// caller that started the batch (the Fetch/FetchContext/FetchWithPriority
+// call that found no pending batch to join and created one). Wrap a real
+// tracer's Tracer type in an adapter implementing this to integrate it.
+type Tracer interface {
+	Start(ctx context.Context, spanName string) (context.Context, Span)
+}
+
+// TracerProvider is the minimal tracer-provider interface singlefleet needs.
+// Wrap a real TracerProvider (e.g. from OpenTelemetry) in a small adapter
+// implementing this to pass it to WithTracerProvider.
+type TracerProvider interface {
+	Tracer(name string) Tracer
+}
+
+// WithObserver registers o to receive batching callbacks; see Observer.
+func WithObserver(o Observer) Option {
+	return func(fc *Fetcher) {
+		fc.observer = o
+	}
+}
+
+// WithTracerProvider opens a span (named "singlefleet.Job") around every
+// batch's Job/JobContext call, using the tracer named name, parented to the
+// context of the caller that started the batch. The span is attached to the
+// context passed to JobContext, without adopting that caller's cancellation
+// (other callers may still be waiting on the batch), so the underlying fetch
+// can attach further child spans.
+func WithTracerProvider(tp TracerProvider, name string) Option {
+	return func(fc *Fetcher) {
+		fc.tracerProvider = tp
+		fc.tracerName = name
+	}
+}
+
+// linkedContext carries values (notably a tracing span) from values while
+// taking its deadline and cancellation from the embedded Context, so a
+// batch's Job can see the span of the caller that started the batch without
+// adopting that single caller's cancellation.
+type linkedContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c linkedContext) Value(key interface{}) interface{} {
+	if v := c.Context.Value(key); v != nil {
+		return v
+	}
+	return c.values.Value(key)
+}
+
+// noopObserver is used when no Observer is configured, so call sites never
+// need to nil-check fc.observer.
+type noopObserver struct{}
+
+func (noopObserver) OnBatchStart(int)                     {}
+func (noopObserver) OnBatchEnd(int, time.Duration, error) {}
+func (noopObserver) OnFetchEnqueued(string)               {}
+func (noopObserver) OnFetchWait(string, time.Duration)    {}
@@ -0,0 +1,51 @@
+package singlefleet
+
+import "container/heap"
+
+// priorityBucket groups the IDs queued for a batch at a single priority
+// level, so higher-priority IDs can be dispatched to the Job ahead of lower-
+// priority ones sharing the same batch.
+type priorityBucket struct {
+	prio int
+	ids  []string
+}
+
+// dispatchWaiter represents a sealed batch waiting for a free MaxConcurrency
+// slot. Waiters are ordered by prio (higher first), ties broken by arrival
+// order so otherwise-equal batches are served fairly.
+type dispatchWaiter struct {
+	prio  int
+	seq   int64
+	ready chan struct{}
+}
+
+// dispatchQueue is a small priority queue of dispatchWaiters, backed by a
+// container/heap, giving O(log n) insertion and removal of the
+// highest-priority waiter.
+type dispatchQueue []*dispatchWaiter
+
+func (q dispatchQueue) Len() int { return len(q) }
+
+func (q dispatchQueue) Less(i, j int) bool {
+	if q[i].prio != q[j].prio {
+		return q[i].prio > q[j].prio
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q dispatchQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *dispatchQueue) Push(x interface{}) {
+	*q = append(*q, x.(*dispatchWaiter))
+}
+
+func (q *dispatchQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	w := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return w
+}
+
+var _ heap.Interface = (*dispatchQueue)(nil)
@@ -4,6 +4,10 @@
 package singlefleet
 
 import (
+	"container/heap"
+	"context"
+	"fmt"
+	"runtime/debug"
 	"sync"
 	"time"
 )
@@ -15,27 +19,262 @@ import (
 // Fetch(es).
 type Job func(ids []string) (vals map[string]interface{}, err error)
 
+// A JobContext is the context-aware variant of Job. It receives a context
+// derived for the batch being executed, so implementations can propagate
+// cancellation and tracing spans into the underlying fetch; it carries no
+// deadline, and callers' deadlines are not copied into it. The
+// context is only canceled once every caller waiting on the batch has either
+// been served or has given up, so a single caller canceling does not abort
+// work still needed by others.
+type JobContext func(ctx context.Context, ids []string) (vals map[string]interface{}, err error)
+
 // batch represents a collection of fetch operations.
 type batch struct {
 	vals map[string]interface{}
 	err  error
 
-	ids  []string
+	// buckets holds the IDs still pending dispatch, grouped by priority and
+	// kept sorted highest-priority-first, so a batch's Job sees its
+	// latency-sensitive IDs ahead of lower-priority ones sharing the same
+	// batch. An ID is added to its bucket the first time a caller joins the
+	// batch for it, and removed again if every caller for that ID cancels
+	// before the batch fires.
+	buckets []priorityBucket
+	// refs counts the active (non-canceled) callers per ID. A key is never
+	// removed once created, so the Fetcher can still find and clean up its
+	// m entry for an ID even after every caller for it has canceled.
+	refs     map[string]int
+	fired    bool
+	resolved bool
+
 	mu   sync.Mutex
-	wg   sync.WaitGroup
-	csig chan struct{}
+	once sync.Once
+	done chan struct{} // closed once the batch has been executed or skipped
+	csig chan struct{} // closed to dispatch the batch ahead of maxWait/maxBatch
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// traceCtx is the context of the caller that started the batch, used
+	// only to parent the span opened around its Job/JobContext call (see
+	// WithTracerProvider); unlike ctx, it plays no part in the batch's own
+	// cancellation, since other callers may still be waiting on the batch
+	// after this particular caller's context is done.
+	traceCtx context.Context
+}
+
+func newBatch(traceCtx context.Context) *batch {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &batch{
+		refs:     make(map[string]int),
+		done:     make(chan struct{}),
+		csig:     make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+		traceCtx: traceCtx,
+	}
+}
+
+// enqueue adds id to its priority bucket, creating the bucket in sorted
+// position (highest priority first) if this is the first ID queued at that
+// priority. Must be called with b.mu held.
+func (b *batch) enqueue(id string, prio int) {
+	for i := range b.buckets {
+		if b.buckets[i].prio == prio {
+			b.buckets[i].ids = append(b.buckets[i].ids, id)
+			return
+		}
+		if b.buckets[i].prio < prio {
+			b.buckets = append(b.buckets, priorityBucket{})
+			copy(b.buckets[i+1:], b.buckets[i:])
+			b.buckets[i] = priorityBucket{prio: prio, ids: []string{id}}
+			return
+		}
+	}
+	b.buckets = append(b.buckets, priorityBucket{prio: prio, ids: []string{id}})
+}
+
+// flattenIDs returns every ID still pending dispatch, highest-priority
+// bucket first, for executing as one Job/JobContext call. Must be called
+// with b.mu held.
+func (b *batch) flattenIDs() []string {
+	ids := make([]string, 0, len(b.refs))
+	for _, bucket := range b.buckets {
+		ids = append(ids, bucket.ids...)
+	}
+	return ids
+}
+
+// maxPrio reports the highest priority among IDs still pending dispatch,
+// used to rank this batch's Job against others competing for a
+// MaxConcurrency slot. Must be called with b.mu held.
+func (b *batch) maxPrio() int {
+	if len(b.buckets) == 0 {
+		return 0
+	}
+	return b.buckets[0].prio
+}
+
+// addCaller registers a caller waiting on id with the given priority,
+// re-queuing id for dispatch if it had previously been removed by every
+// other caller canceling. Reports whether id was freshly queued as a result.
+func (b *batch) addCaller(id string, prio int) (queued bool) {
+	b.mu.Lock()
+	if b.refs[id] == 0 && !b.fired {
+		b.enqueue(id, prio)
+		queued = true
+	}
+	b.refs[id]++
+	b.mu.Unlock()
+	return queued
+}
+
+// removeCaller withdraws a canceled caller's interest in id, dropping id from
+// the pending batch once no caller is left waiting on it. Reports whether id
+// was dropped this way, so the Fetcher can also forget its fc.m[id] entry
+// and let a later Fetch for id start a fresh batch instead of joining this
+// one, which will never cover id.
+func (b *batch) removeCaller(id string) (evicted bool) {
+	b.mu.Lock()
+	b.refs[id]--
+	if b.refs[id] <= 0 && !b.fired {
+		for bi := range b.buckets {
+			ids := b.buckets[bi].ids
+			for i, v := range ids {
+				if v == id {
+					b.buckets[bi].ids = append(ids[:i], ids[i+1:]...)
+					evicted = true
+					break
+				}
+			}
+			if evicted {
+				if len(b.buckets[bi].ids) == 0 {
+					b.buckets = append(b.buckets[:bi], b.buckets[bi+1:]...)
+				}
+				break
+			}
+		}
+	}
+	b.mu.Unlock()
+	return evicted
+}
+
+// resolve records the outcome of the batch's Job, ignoring any outcome
+// reported after the first one (e.g. a job that finishes after MaxJobDuration
+// has already released its waiters with a timeout error). Reports whether
+// this call's outcome was the one recorded.
+func (b *batch) resolve(vals map[string]interface{}, err error) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.resolved {
+		return false
+	}
+	b.resolved = true
+	b.vals, b.err = vals, err
+	return true
+}
+
+// shouldFire reports whether the batch has reached maxBatch pending IDs.
+func (b *batch) shouldFire(maxBatch int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for _, bucket := range b.buckets {
+		n += len(bucket.ids)
+	}
+	return n >= maxBatch
+}
+
+// fire dispatches the batch ahead of maxWait. Safe to call more than once
+// and from multiple goroutines.
+func (b *batch) fire() {
+	b.once.Do(func() { close(b.csig) })
 }
 
 // A Fetcher represents a fetch operation and contains the batch pool. Must be
-// created with NewFetcher.
+// created with NewFetcher or NewFetcherContext.
 type Fetcher struct {
 	maxw time.Duration
 	maxb int
 
-	mu sync.Mutex
-	m  map[string]*batch
-	b  *batch
-	f  Job
+	// PanicHandler, if set, is called with the recovered value whenever a
+	// Job or JobContext panics, e.g. for logging or metrics. The panic is
+	// always converted into an error delivered to every waiting caller
+	// regardless of whether PanicHandler is set.
+	PanicHandler func(interface{})
+
+	// MaxJobDuration, if positive, bounds how long a single batch's Job or
+	// JobContext is allowed to run. Once it elapses, every caller waiting on
+	// the batch is released with a timeout error even if the underlying
+	// call is still running in the background; its eventual result is
+	// discarded.
+	MaxJobDuration time.Duration
+
+	// MaxConcurrency, if positive, bounds how many batches may have their Job
+	// or JobContext running at the same time. A sealed batch beyond this
+	// limit still frees up fc.b immediately, so new Fetch/FetchContext calls
+	// can start filling the next batch; only the execution of the sealed
+	// batch's Job waits for a free slot.
+	MaxConcurrency int
+
+	mu   sync.Mutex
+	m    map[string]*batch
+	b    *batch
+	f    Job
+	fctx JobContext
+
+	dmu       sync.Mutex
+	inFlight  int
+	dispatchQ dispatchQueue
+	dispatchN int64
+
+	cache           *cache
+	cacheEnabled    bool
+	cacheSize       int
+	cacheTTL        time.Duration
+	negCacheEnabled bool
+	negCacheTTL     time.Duration
+
+	priorityThreshold int
+
+	observer       Observer
+	tracerProvider TracerProvider
+	tracerName     string
+}
+
+// An Option configures optional behavior on a Fetcher, applied in NewFetcher
+// or NewFetcherContext.
+type Option func(*Fetcher)
+
+// WithCache enables an in-process result cache holding up to size entries
+// (the least recently used entry is evicted once full; size <= 0 means
+// unbounded). A successful Fetch/FetchContext result is cached for ttl,
+// after which it is treated as a miss again. Errors are never cached.
+func WithCache(size int, ttl time.Duration) Option {
+	return func(fc *Fetcher) {
+		fc.cacheEnabled = true
+		fc.cacheSize = size
+		fc.cacheTTL = ttl
+	}
+}
+
+// WithNegativeCache additionally caches "not found" (ok == false) outcomes
+// for ttl, so repeated lookups of nonexistent IDs don't repeatedly reach the
+// Job. It has no effect unless WithCache is also given.
+func WithNegativeCache(ttl time.Duration) Option {
+	return func(fc *Fetcher) {
+		fc.negCacheEnabled = true
+		fc.negCacheTTL = ttl
+	}
+}
+
+// WithPriorityThreshold makes a FetchWithPriority call with prio >= threshold
+// dispatch its batch immediately, instead of waiting for maxWait or maxBatch.
+// A threshold <= 0 disables early dispatch.
+func WithPriorityThreshold(threshold int) Option {
+	return func(fc *Fetcher) {
+		fc.priorityThreshold = threshold
+	}
 }
 
 // NewFetcher creates a new Fetcher. It holds the execution of jobs in the
@@ -46,110 +285,343 @@ type Fetcher struct {
 // To ignore the maxWait rule simply set a sufficiently long duration.
 // Likewise, to ignore the maxBatch rule simply set a sufficiently large
 // integer value.
-func NewFetcher(job Job, maxWait time.Duration, maxBatch int) *Fetcher {
-	return &Fetcher{
+func NewFetcher(job Job, maxWait time.Duration, maxBatch int, opts ...Option) *Fetcher {
+	fc := &Fetcher{
 		f:    job,
 		maxw: maxWait,
 		maxb: maxBatch,
 		m:    make(map[string]*batch),
 	}
+	fc.applyOptions(opts)
+	return fc
+}
+
+// NewFetcherContext creates a new Fetcher whose Job is context-aware. It
+// behaves exactly like NewFetcher, except the job receives a context derived
+// for each batch, which is canceled once the batch is done (its job has
+// returned or MaxJobDuration has elapsed), so that cancellation can propagate
+// down to the underlying fetch. The context has no deadline, and a caller's
+// own ctx being canceled or expiring does not cancel it.
+func NewFetcherContext(job JobContext, maxWait time.Duration, maxBatch int, opts ...Option) *Fetcher {
+	fc := &Fetcher{
+		fctx: job,
+		maxw: maxWait,
+		maxb: maxBatch,
+		m:    make(map[string]*batch),
+	}
+	fc.applyOptions(opts)
+	return fc
+}
+
+func (fc *Fetcher) applyOptions(opts []Option) {
+	for _, opt := range opts {
+		opt(fc)
+	}
+	if fc.cacheEnabled {
+		fc.cache = newCache(fc.cacheSize)
+	}
+	if fc.observer == nil {
+		fc.observer = noopObserver{}
+	}
 }
 
 // Fetch places a fetch job in the batch pool and returns the result of the
-// operation.
+// operation. It is equivalent to FetchContext with context.Background().
 func (fc *Fetcher) Fetch(id string) (val interface{}, ok bool, err error) {
+	return fc.fetch(context.Background(), id, 0)
+}
+
+// FetchContext places a fetch job in the batch pool and returns the result of
+// the operation, honoring ctx. If ctx is canceled or its deadline expires
+// before the batch fires, FetchContext returns ctx.Err() immediately and its
+// ID is removed from the pending batch; if every caller for a batch cancels
+// this way, the underlying Job is skipped entirely.
+func (fc *Fetcher) FetchContext(ctx context.Context, id string) (val interface{}, ok bool, err error) {
+	return fc.fetch(ctx, id, 0)
+}
+
+// FetchWithPriority is like Fetch, but prio influences how its batch is
+// formed and dispatched: a batch containing a high enough prio (see
+// WithPriorityThreshold) fires immediately rather than waiting for maxWait or
+// maxBatch, and its Job is favored over lower-priority batches competing for
+// a MaxConcurrency slot.
+func (fc *Fetcher) FetchWithPriority(id string, prio int) (val interface{}, ok bool, err error) {
+	return fc.fetch(context.Background(), id, prio)
+}
+
+func (fc *Fetcher) fetch(ctx context.Context, id string, prio int) (val interface{}, ok bool, err error) {
+	if fc.cache != nil {
+		if v, cok, found := fc.cache.get(id); found {
+			return v, cok, nil
+		}
+	}
+
+	start := time.Now()
+
 	fc.mu.Lock()
 
 	// Check if given ID is already queued in current batch
-	if b, ok := fc.m[id]; ok {
-		// It is, then just wait for call
+	if b, exists := fc.m[id]; exists {
 		fc.mu.Unlock()
-		b.wg.Wait()
-		val, ok = b.vals[id]
-		return val, ok, b.err
+		if b.addCaller(id, prio) {
+			fc.observer.OnFetchEnqueued(id)
+		}
+		fc.maybeFireEarly(b, prio)
+		return fc.await(ctx, b, id, start)
 	}
 
-	// Check if this group has a pending batch
+	// Check if this group has a pending batch. addCaller is called before
+	// unlocking fc.mu, under the same lock run() takes to seal the batch
+	// (see run), so a caller that observes fc.b == b here is guaranteed to
+	// either land in the batch's snapshot or be told it wasn't queued.
 	if fc.b != nil {
-		// It does, then init first call for given ID
 		b := fc.b
 		fc.m[id] = b
+		queued := b.addCaller(id, prio)
 		fc.mu.Unlock()
-		b.mu.Lock()
-		b.ids = append(b.ids, id)
-		if len(b.ids) >= fc.maxb {
-			fc.mu.Lock()
-			b.csig <- struct{}{}
+
+		if queued {
+			fc.observer.OnFetchEnqueued(id)
+		}
+		if b.shouldFire(fc.maxb) {
+			b.fire()
+		} else {
+			fc.maybeFireEarly(b, prio)
 		}
-		b.mu.Unlock()
+		return fc.await(ctx, b, id, start)
+	}
+
+	// Init first call of its batch
+	b := newBatch(ctx)
+	fc.b = b
+	fc.m[id] = b
+	fc.mu.Unlock()
 
-		// Wait for call
-		b.wg.Wait()
+	if b.addCaller(id, prio) {
+		fc.observer.OnFetchEnqueued(id)
+	}
+	go fc.run(b)
+	fc.maybeFireEarly(b, prio)
 
-		// Cleanup
-		fc.mu.Lock()
-		delete(fc.m, id)
-		fc.mu.Unlock()
+	return fc.await(ctx, b, id, start)
+}
+
+// maybeFireEarly dispatches b ahead of maxWait/maxBatch if prio has reached
+// the threshold set by WithPriorityThreshold.
+func (fc *Fetcher) maybeFireEarly(b *batch, prio int) {
+	if fc.priorityThreshold > 0 && prio >= fc.priorityThreshold {
+		b.fire()
+	}
+}
 
+// await blocks until b has been executed or ctx is done, whichever comes
+// first.
+func (fc *Fetcher) await(ctx context.Context, b *batch, id string, start time.Time) (val interface{}, ok bool, err error) {
+	defer func() { fc.observer.OnFetchWait(id, time.Since(start)) }()
+
+	select {
+	case <-b.done:
 		val, ok = b.vals[id]
 		return val, ok, b.err
+	case <-ctx.Done():
+		if b.removeCaller(id) {
+			// id won't be in this batch's executed set; forget it so a
+			// later Fetch(id) starts a fresh batch instead of joining this
+			// one and waiting on a result it will never contain.
+			fc.mu.Lock()
+			if fc.m[id] == b {
+				delete(fc.m, id)
+			}
+			fc.mu.Unlock()
+		}
+		return nil, false, ctx.Err()
 	}
+}
 
-	// Init first call of its batch
-	b := new(batch)
-	b.mu.Lock()
-	b.wg.Add(1)
-	b.ids = make([]string, 0, fc.maxb)
-	b.ids = append(b.ids, id)
-	b.csig = make(chan struct{})
-	b.mu.Unlock()
-	fc.b = b
-	fc.m[id] = b
+// FetchNow forces the current pending job batch to be executed, disregarding
+// the maxWait and maxBatch rules.
+func (fc *Fetcher) FetchNow() bool {
+	fc.mu.Lock()
+	b := fc.b
 	fc.mu.Unlock()
 
-	// Wait for signal
+	// Return immediately if there is no pending batch
+	if b == nil {
+		return false
+	}
+
+	b.fire()
+	return true
+}
+
+// acquireSlot reserves one of MaxConcurrency worker slots, blocking if they
+// are all in use. Waiters are served in priority order (see
+// WithPriorityThreshold and FetchWithPriority), ties broken by arrival order.
+// If MaxConcurrency is not positive, it is a no-op.
+func (fc *Fetcher) acquireSlot(prio int) (release func()) {
+	if fc.MaxConcurrency <= 0 {
+		return func() {}
+	}
+
+	fc.dmu.Lock()
+	if fc.inFlight < fc.MaxConcurrency {
+		fc.inFlight++
+		fc.dmu.Unlock()
+		return fc.releaseSlot
+	}
+	fc.dispatchN++
+	w := &dispatchWaiter{prio: prio, seq: fc.dispatchN, ready: make(chan struct{})}
+	heap.Push(&fc.dispatchQ, w)
+	fc.dmu.Unlock()
+
+	<-w.ready
+	return fc.releaseSlot
+}
+
+// releaseSlot frees a worker slot reserved by acquireSlot, handing it
+// directly to the highest-priority waiter if one is queued.
+func (fc *Fetcher) releaseSlot() {
+	fc.dmu.Lock()
+	if fc.dispatchQ.Len() > 0 {
+		w := heap.Pop(&fc.dispatchQ).(*dispatchWaiter)
+		fc.dmu.Unlock()
+		close(w.ready)
+		return
+	}
+	fc.inFlight--
+	fc.dmu.Unlock()
+}
+
+// run waits for b to be ready for dispatch, then executes it and releases
+// every caller waiting on it.
+func (fc *Fetcher) run(b *batch) {
 	t := time.NewTimer(fc.maxw)
 	select {
 	case <-t.C:
-		fc.mu.Lock()
-		close(b.csig)
 	case <-b.csig:
 		t.Stop()
 	}
-	fc.b = nil
+
+	// fc.b is niled and the batch sealed (fired + snapshotted) under fc.mu,
+	// the same lock fetch's join-pending-batch branch holds while deciding
+	// whether to add a caller to b. This keeps the two decisions (is this
+	// batch still joinable? what does it end up dispatching?) consistent:
+	// a caller that joined while fc.b == b is always reflected below.
+	fc.mu.Lock()
+	if fc.b == b {
+		fc.b = nil
+	}
+	b.mu.Lock()
+	b.fired = true
+	ids := b.flattenIDs()
+	prio := b.maxPrio()
+	joined := make([]string, 0, len(b.refs))
+	for id := range b.refs {
+		joined = append(joined, id)
+	}
+	b.mu.Unlock()
 	fc.mu.Unlock()
 
-	// Do call
-	fc.doFetch(b)
-	b.wg.Done()
+	// Every caller canceled before the batch fired; skip the Job entirely.
+	if len(ids) > 0 {
+		release := fc.acquireSlot(prio)
+		fc.observer.OnBatchStart(len(ids))
+		jobStart := time.Now()
+		fc.doFetch(b, ids)
+		dur := time.Since(jobStart)
+		release()
+		fc.observer.OnBatchEnd(len(ids), dur, b.err)
+		fc.populateCache(b, ids)
+	}
+	b.cancel()
+	close(b.done)
 
 	// Cleanup
 	fc.mu.Lock()
-	delete(fc.m, id)
+	for _, id := range joined {
+		if fc.m[id] == b {
+			delete(fc.m, id)
+		}
+	}
 	fc.mu.Unlock()
-
-	val, ok = b.vals[id]
-	return val, ok, b.err
 }
 
-// FetchNow forces the current pending job batch to be executed, disregarding
-// the maxWait and maxBatch rules.
-func (fc *Fetcher) FetchNow() bool {
-	fc.mu.Lock()
+func (fc *Fetcher) doFetch(b *batch, ids []string) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() {
+			if r := recover(); r != nil {
+				if fc.PanicHandler != nil {
+					fc.PanicHandler(r)
+				}
+				b.resolve(nil, fmt.Errorf("singlefleet: job panicked: %v\n%s", r, debug.Stack()))
+			}
+		}()
 
-	// Return immediately if there is no pending batch
-	if fc.b == nil {
-		fc.mu.Unlock()
-		return false
+		ctx := b.ctx
+		if fc.tracerProvider != nil {
+			parent := b.traceCtx
+			if parent == nil {
+				parent = context.Background()
+			}
+			spanCtx, span := fc.tracerProvider.Tracer(fc.tracerName).Start(parent, "singlefleet.Job")
+			ctx = linkedContext{Context: b.ctx, values: spanCtx}
+			defer span.End()
+		}
+
+		var vals map[string]interface{}
+		var err error
+		if fc.fctx != nil {
+			vals, err = fc.fctx(ctx, ids)
+		} else {
+			vals, err = fc.f(ids)
+		}
+		b.resolve(vals, err)
+	}()
+
+	if fc.MaxJobDuration <= 0 {
+		<-done
+		return
+	}
+
+	select {
+	case <-done:
+	case <-time.After(fc.MaxJobDuration):
+		b.resolve(nil, fmt.Errorf("singlefleet: job timed out after %s", fc.MaxJobDuration))
 	}
+}
 
-	// Send signal to execute fetch immediately
-	fc.b.csig <- struct{}{}
+// populateCache stores the outcome of a just-executed batch for every ID it
+// covered, if a cache is configured. Errors are never cached.
+func (fc *Fetcher) populateCache(b *batch, ids []string) {
+	if fc.cache == nil || b.err != nil {
+		return
+	}
+	for _, id := range ids {
+		if val, ok := b.vals[id]; ok {
+			fc.cache.set(id, val, true, fc.cacheTTL)
+		} else if fc.negCacheEnabled {
+			fc.cache.set(id, nil, false, fc.negCacheTTL)
+		}
+	}
+}
 
-	return true
+// Invalidate evicts ids from the result cache, if one is configured via
+// WithCache. It is a no-op otherwise.
+func (fc *Fetcher) Invalidate(ids ...string) {
+	if fc.cache == nil {
+		return
+	}
+	fc.cache.invalidate(ids...)
 }
 
-func (fc *Fetcher) doFetch(c *batch) {
-	// TODO: handle panic?
-	c.vals, c.err = fc.f(c.ids)
+// Prime seeds the result cache with val for id, as if it had just been
+// fetched successfully, if a cache is configured via WithCache. It is a
+// no-op otherwise.
+func (fc *Fetcher) Prime(id string, val interface{}) {
+	if fc.cache == nil {
+		return
+	}
+	fc.cache.set(id, val, true, fc.cacheTTL)
 }
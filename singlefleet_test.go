@@ -1,6 +1,7 @@
 package singlefleet
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strconv"
@@ -166,3 +167,590 @@ func TestFetchNowNoQueue(t *testing.T) {
 		t.Errorf("FetchNow = %v, want false", fnok)
 	}
 }
+
+func TestFetchContextCanceled(t *testing.T) {
+	f := NewFetcher(func(ids []string) (map[string]interface{}, error) {
+		t.Errorf("Job called, want skipped (all callers canceled)")
+		return make(map[string]interface{}), nil
+	}, 5*time.Second, 1000)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	v, ok, err := f.FetchContext(ctx, "a")
+	if err != context.Canceled {
+		t.Errorf("FetchContext error = %v, want %v", err, context.Canceled)
+	}
+	if ok != false || v != nil {
+		t.Errorf("FetchContext = %v, %v, want nil, false", v, ok)
+	}
+}
+
+func TestFetchContextPropagation(t *testing.T) {
+	var sawCtx context.Context
+	f := NewFetcherContext(func(ctx context.Context, ids []string) (map[string]interface{}, error) {
+		sawCtx = ctx
+		res := make(map[string]interface{})
+		for _, id := range ids {
+			res[id] = strings.ToUpper(id)
+		}
+		return res, ctx.Err()
+	}, 100*time.Millisecond, 1)
+
+	v, ok, err := f.FetchContext(context.Background(), "a")
+	if err != nil {
+		t.Errorf("FetchContext error = %v", err)
+	}
+	if !ok || v != "A" {
+		t.Errorf("FetchContext = %v, %v, want A, true", v, ok)
+	}
+	if sawCtx == nil {
+		t.Errorf("Job did not receive a context")
+	}
+}
+
+func TestFetchContextCanceledThenRefetch(t *testing.T) {
+	unblock := make(chan struct{})
+	f := NewFetcher(func(ids []string) (map[string]interface{}, error) {
+		<-unblock // keep the batch "executing" so we can refetch mid-flight
+		res := make(map[string]interface{})
+		for _, id := range ids {
+			res[id] = strings.ToUpper(id)
+		}
+		return res, nil
+	}, 5*time.Millisecond, 1000)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); f.FetchContext(ctx, "a") }()
+	go func() { defer wg.Done(); f.Fetch("b") }()
+	time.Sleep(2 * time.Millisecond) // let both join the same pending batch
+	cancel()                         // "a" cancels before the batch fires
+
+	time.Sleep(10 * time.Millisecond) // batch fires (maxWait) and blocks in the Job
+
+	// While the batch covering only "b" is still executing, refetch "a". It
+	// must not join that batch (which never covers "a") and come back
+	// not-found; it must start a fresh batch for "a".
+	refetchDone := make(chan struct{})
+	var v interface{}
+	var ok bool
+	var err error
+	go func() {
+		v, ok, err = f.Fetch("a")
+		close(refetchDone)
+	}()
+	time.Sleep(2 * time.Millisecond) // let the refetch goroutine run past the lookup
+	close(unblock)                   // let the in-flight batch finish
+	wg.Wait()
+
+	select {
+	case <-refetchDone:
+	case <-time.After(time.Second):
+		t.Fatal("refetch of \"a\" never returned")
+	}
+	if err != nil || !ok || v != "A" {
+		t.Errorf("Fetch(%q) after cancel+refetch = %v, %v, %v, want A, true, nil", "a", v, ok, err)
+	}
+}
+
+func TestFetchPanicRecovery(t *testing.T) {
+	var recovered interface{}
+	f := NewFetcher(func(ids []string) (map[string]interface{}, error) {
+		panic("boom")
+	}, 100*time.Millisecond, 1)
+	f.PanicHandler = func(r interface{}) {
+		recovered = r
+	}
+
+	v, ok, err := f.Fetch("a")
+	if err == nil {
+		t.Errorf("Fetch error = nil, want a panic error")
+	}
+	if ok != false || v != nil {
+		t.Errorf("Fetch = %v, %v, want nil, false", v, ok)
+	}
+	if recovered != "boom" {
+		t.Errorf("PanicHandler received %v, want %v", recovered, "boom")
+	}
+}
+
+func TestFetchCacheHit(t *testing.T) {
+	ncall := 0
+	f := NewFetcher(func(ids []string) (map[string]interface{}, error) {
+		ncall++
+		res := make(map[string]interface{})
+		for _, id := range ids {
+			res[id] = strings.ToUpper(id)
+		}
+		return res, nil
+	}, 10*time.Millisecond, 1, WithCache(10, time.Hour))
+
+	for i := 0; i < 3; i++ {
+		v, ok, err := f.Fetch("a")
+		if err != nil || !ok || v != "A" {
+			t.Errorf("Fetch = %v, %v, %v, want A, true, nil", v, ok, err)
+		}
+	}
+	if ncall != 1 {
+		t.Errorf("Job called %v times, want 1 (cache should have been hit)", ncall)
+	}
+}
+
+func TestFetchCacheExpiry(t *testing.T) {
+	ncall := 0
+	f := NewFetcher(func(ids []string) (map[string]interface{}, error) {
+		ncall++
+		res := make(map[string]interface{})
+		for _, id := range ids {
+			res[id] = strings.ToUpper(id)
+		}
+		return res, nil
+	}, 10*time.Millisecond, 1, WithCache(10, 20*time.Millisecond))
+
+	f.Fetch("a")
+	time.Sleep(50 * time.Millisecond)
+	f.Fetch("a")
+	if ncall != 2 {
+		t.Errorf("Job called %v times, want 2 (cache entry should have expired)", ncall)
+	}
+}
+
+func TestFetchNegativeCache(t *testing.T) {
+	ncall := 0
+	f := NewFetcher(func(ids []string) (map[string]interface{}, error) {
+		ncall++
+		return make(map[string]interface{}), nil
+	}, 10*time.Millisecond, 1, WithCache(10, time.Hour), WithNegativeCache(time.Hour))
+
+	for i := 0; i < 3; i++ {
+		_, ok, err := f.Fetch("missing")
+		if err != nil || ok {
+			t.Errorf("Fetch = ok %v, err %v, want false, nil", ok, err)
+		}
+	}
+	if ncall != 1 {
+		t.Errorf("Job called %v times, want 1 (negative result should have been cached)", ncall)
+	}
+}
+
+func TestFetchInvalidateAndPrime(t *testing.T) {
+	ncall := 0
+	f := NewFetcher(func(ids []string) (map[string]interface{}, error) {
+		ncall++
+		res := make(map[string]interface{})
+		for _, id := range ids {
+			res[id] = strings.ToUpper(id)
+		}
+		return res, nil
+	}, 10*time.Millisecond, 1, WithCache(10, time.Hour))
+
+	f.Fetch("a")
+	f.Invalidate("a")
+	f.Fetch("a")
+	if ncall != 2 {
+		t.Errorf("Job called %v times, want 2 (Invalidate should have evicted the entry)", ncall)
+	}
+
+	f.Prime("b", "PRIMED")
+	v, ok, err := f.Fetch("b")
+	if err != nil || !ok || v != "PRIMED" {
+		t.Errorf("Fetch = %v, %v, %v, want PRIMED, true, nil", v, ok, err)
+	}
+	if ncall != 2 {
+		t.Errorf("Job called %v times, want 2 (Prime should have seeded the cache)", ncall)
+	}
+}
+
+func TestFetchCacheThunderingHerd(t *testing.T) {
+	var wg sync.WaitGroup
+	ncall := 0
+	f := NewFetcher(func(ids []string) (map[string]interface{}, error) {
+		ncall++
+		time.Sleep(50 * time.Millisecond)
+		res := make(map[string]interface{})
+		for _, id := range ids {
+			res[id] = strings.ToUpper(id)
+		}
+		return res, nil
+	}, 5*time.Second, 1000, WithCache(10, time.Hour))
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, ok, err := f.Fetch("a")
+			if err != nil || !ok || v != "A" {
+				t.Errorf("Fetch = %v, %v, %v, want A, true, nil", v, ok, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if ncall != 1 {
+		t.Errorf("Job called %v times, want 1 (cold key should be deduped through the batch)", ncall)
+	}
+}
+
+type recordingObserver struct {
+	mu         sync.Mutex
+	enqueued   []string
+	batchSizes []int
+	batchErrs  []error
+	waited     []string
+}
+
+func (o *recordingObserver) OnBatchStart(size int) {
+	o.mu.Lock()
+	o.batchSizes = append(o.batchSizes, size)
+	o.mu.Unlock()
+}
+
+func (o *recordingObserver) OnBatchEnd(size int, dur time.Duration, err error) {
+	o.mu.Lock()
+	o.batchErrs = append(o.batchErrs, err)
+	o.mu.Unlock()
+}
+
+func (o *recordingObserver) OnFetchEnqueued(id string) {
+	o.mu.Lock()
+	o.enqueued = append(o.enqueued, id)
+	o.mu.Unlock()
+}
+
+func (o *recordingObserver) OnFetchWait(id string, dur time.Duration) {
+	o.mu.Lock()
+	o.waited = append(o.waited, id)
+	o.mu.Unlock()
+}
+
+func TestFetchObserver(t *testing.T) {
+	obs := &recordingObserver{}
+	f := NewFetcher(func(ids []string) (map[string]interface{}, error) {
+		res := make(map[string]interface{})
+		for _, id := range ids {
+			res[id] = strings.ToUpper(id)
+		}
+		return res, nil
+	}, 20*time.Millisecond, 1000, WithObserver(obs))
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); f.Fetch("a") }()
+	go func() { defer wg.Done(); f.Fetch("b") }()
+	wg.Wait()
+
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	if len(obs.enqueued) != 2 {
+		t.Errorf("enqueued = %v, want 2 entries", obs.enqueued)
+	}
+	if len(obs.batchSizes) != 1 || obs.batchSizes[0] != 2 {
+		t.Errorf("batchSizes = %v, want [2]", obs.batchSizes)
+	}
+	if len(obs.batchErrs) != 1 || obs.batchErrs[0] != nil {
+		t.Errorf("batchErrs = %v, want [nil]", obs.batchErrs)
+	}
+	if len(obs.waited) != 2 {
+		t.Errorf("waited = %v, want 2 entries", obs.waited)
+	}
+}
+
+type recordingSpan struct {
+	ended bool
+}
+
+func (s *recordingSpan) End() { s.ended = true }
+
+type recordingTracer struct {
+	mu      sync.Mutex
+	started []string
+	spans   []*recordingSpan
+	parents []context.Context
+}
+
+func (tr *recordingTracer) Start(ctx context.Context, spanName string) (context.Context, Span) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.started = append(tr.started, spanName)
+	tr.parents = append(tr.parents, ctx)
+	s := &recordingSpan{}
+	tr.spans = append(tr.spans, s)
+	return ctx, s
+}
+
+type recordingTracerProvider struct {
+	tracer *recordingTracer
+}
+
+func (tp *recordingTracerProvider) Tracer(name string) Tracer {
+	return tp.tracer
+}
+
+func TestFetchTracerProvider(t *testing.T) {
+	tracer := &recordingTracer{}
+	f := NewFetcherContext(func(ctx context.Context, ids []string) (map[string]interface{}, error) {
+		res := make(map[string]interface{})
+		for _, id := range ids {
+			res[id] = strings.ToUpper(id)
+		}
+		return res, nil
+	}, 20*time.Millisecond, 1, WithTracerProvider(&recordingTracerProvider{tracer: tracer}, "singlefleet-test"))
+
+	f.FetchContext(context.Background(), "a")
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	if len(tracer.started) != 1 || tracer.started[0] != "singlefleet.Job" {
+		t.Errorf("started = %v, want [singlefleet.Job]", tracer.started)
+	}
+	if len(tracer.spans) != 1 || !tracer.spans[0].ended {
+		t.Errorf("span ended = %v, want true", tracer.spans)
+	}
+}
+
+type traceIDKey struct{}
+
+func TestFetchTracerProviderLinksCallerContext(t *testing.T) {
+	tracer := &recordingTracer{}
+	var gotFromJob interface{}
+	f := NewFetcherContext(func(ctx context.Context, ids []string) (map[string]interface{}, error) {
+		gotFromJob = ctx.Value(traceIDKey{})
+		res := make(map[string]interface{})
+		for _, id := range ids {
+			res[id] = strings.ToUpper(id)
+		}
+		return res, nil
+	}, 5*time.Millisecond, 1, WithTracerProvider(&recordingTracerProvider{tracer: tracer}, "singlefleet-test"))
+
+	ctx := context.WithValue(context.Background(), traceIDKey{}, "trace-123")
+	if _, _, err := f.FetchContext(ctx, "a"); err != nil {
+		t.Fatalf("FetchContext error = %v", err)
+	}
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	if len(tracer.parents) != 1 || tracer.parents[0].Value(traceIDKey{}) != "trace-123" {
+		t.Errorf("span parented to %v, want a context carrying the caller's trace-123 value", tracer.parents)
+	}
+	if gotFromJob != "trace-123" {
+		t.Errorf("JobContext ctx value = %v, want trace-123 propagated from the caller that started the batch", gotFromJob)
+	}
+}
+
+func TestFetchWithPriorityEarlyDispatch(t *testing.T) {
+	start := time.Now()
+	var elapsed time.Duration
+	f := NewFetcher(func(ids []string) (map[string]interface{}, error) {
+		elapsed = time.Since(start)
+		res := make(map[string]interface{})
+		for _, id := range ids {
+			res[id] = id
+		}
+		return res, nil
+	}, 5*time.Second, 1000, WithPriorityThreshold(5))
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		f.Fetch("low")
+	}()
+	go func() {
+		defer wg.Done()
+		time.Sleep(20 * time.Millisecond)
+		f.FetchWithPriority("urgent", 10)
+	}()
+	wg.Wait()
+
+	if elapsed > 200*time.Millisecond {
+		t.Errorf("batch took %v to dispatch, want well under maxWait due to priority threshold", elapsed)
+	}
+}
+
+func TestFetchWithPriorityEarlyDispatchLoneCaller(t *testing.T) {
+	start := time.Now()
+	var elapsed time.Duration
+	f := NewFetcher(func(ids []string) (map[string]interface{}, error) {
+		elapsed = time.Since(start)
+		res := make(map[string]interface{})
+		for _, id := range ids {
+			res[id] = id
+		}
+		return res, nil
+	}, 3*time.Second, 1000, WithPriorityThreshold(5))
+
+	v, ok, err := f.FetchWithPriority("urgent", 10)
+	if err != nil {
+		t.Errorf("FetchWithPriority error = %v", err)
+	}
+	if !ok || v != "urgent" {
+		t.Errorf("FetchWithPriority = %v, %v, want urgent, true", v, ok)
+	}
+	if elapsed > 200*time.Millisecond {
+		t.Errorf("lone urgent fetch took %v to dispatch, want well under maxWait due to priority threshold", elapsed)
+	}
+}
+
+func TestFetchWithPriorityDispatchOrder(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	f := NewFetcher(func(ids []string) (map[string]interface{}, error) {
+		mu.Lock()
+		order = append(order, ids[0])
+		mu.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		res := make(map[string]interface{})
+		for _, id := range ids {
+			res[id] = id
+		}
+		return res, nil
+	}, 5*time.Millisecond, 1000)
+	f.MaxConcurrency = 1
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		f.FetchWithPriority("first", 0) // grabs the only slot for 100ms
+	}()
+	go func() {
+		defer wg.Done()
+		time.Sleep(30 * time.Millisecond) // its own batch fires and queues for the slot first
+		f.FetchWithPriority("low", 1)
+	}()
+	go func() {
+		defer wg.Done()
+		time.Sleep(45 * time.Millisecond) // queues for the slot after "low", but higher priority
+		f.FetchWithPriority("high", 9)
+	}()
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(order) != 3 || order[0] != "first" || order[1] != "high" || order[2] != "low" {
+		t.Errorf("dispatch order = %v, want [first high low]", order)
+	}
+}
+
+func TestFetchWithPriorityOrdersBatchByPriority(t *testing.T) {
+	var gotIDs []string
+	f := NewFetcher(func(ids []string) (map[string]interface{}, error) {
+		gotIDs = append([]string(nil), ids...)
+		res := make(map[string]interface{})
+		for _, id := range ids {
+			res[id] = id
+		}
+		return res, nil
+	}, time.Hour, 1000)
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		f.FetchWithPriority("low", 1)
+	}()
+	go func() {
+		defer wg.Done()
+		f.FetchWithPriority("high", 9)
+	}()
+	go func() {
+		defer wg.Done()
+		f.FetchWithPriority("mid", 5)
+	}()
+	time.Sleep(20 * time.Millisecond) // let all three join the same pending batch
+	if !f.FetchNow() {
+		t.Fatal("FetchNow reported no pending batch")
+	}
+	wg.Wait()
+
+	if len(gotIDs) != 3 || gotIDs[0] != "high" || gotIDs[1] != "mid" || gotIDs[2] != "low" {
+		t.Errorf("Job ids = %v, want [high mid low] (batch dispatches its highest-priority bucket first)", gotIDs)
+	}
+}
+
+func TestFetchConcurrentJoinDuringSeal(t *testing.T) {
+	f := NewFetcher(func(ids []string) (map[string]interface{}, error) {
+		res := make(map[string]interface{})
+		for _, id := range ids {
+			res[id] = strings.ToUpper(id)
+		}
+		return res, nil
+	}, time.Microsecond, 1000)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				v, ok, err := f.Fetch("a")
+				if err != nil || !ok || v != "A" {
+					t.Errorf("Fetch(%q) = %v, %v, %v, want A, true, nil", "a", v, ok, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestFetchMaxConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	var cur, max int
+	f := NewFetcher(func(ids []string) (map[string]interface{}, error) {
+		mu.Lock()
+		cur++
+		if cur > max {
+			max = cur
+		}
+		mu.Unlock()
+
+		time.Sleep(100 * time.Millisecond)
+
+		mu.Lock()
+		cur--
+		mu.Unlock()
+
+		res := make(map[string]interface{})
+		for _, id := range ids {
+			res[id] = id
+		}
+		return res, nil
+	}, 10*time.Millisecond, 1)
+	f.MaxConcurrency = 2
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			f.Fetch(strconv.Itoa(id))
+		}(i)
+		time.Sleep(15 * time.Millisecond) // force each into its own batch
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if max > 2 {
+		t.Errorf("observed %v concurrent batches, want at most 2", max)
+	}
+	if max < 2 {
+		t.Errorf("observed %v concurrent batches, want at least 2 (batches should overlap)", max)
+	}
+}
+
+func TestFetchMaxJobDuration(t *testing.T) {
+	f := NewFetcher(func(ids []string) (map[string]interface{}, error) {
+		time.Sleep(200 * time.Millisecond)
+		return map[string]interface{}{"a": "A"}, nil
+	}, 100*time.Millisecond, 1)
+	f.MaxJobDuration = 50 * time.Millisecond
+
+	v, ok, err := f.Fetch("a")
+	if err == nil {
+		t.Errorf("Fetch error = nil, want a timeout error")
+	}
+	if ok != false || v != nil {
+		t.Errorf("Fetch = %v, %v, want nil, false", v, ok)
+	}
+}